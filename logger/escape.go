@@ -0,0 +1,125 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+)
+
+// escapeMode selects how a field's rendered value is escaped before being
+// appended to the line, so that attacker-controlled values such as headers
+// or request URIs cannot inject quotes, newlines or control bytes into the
+// log stream.
+type escapeMode int
+
+const (
+	// escapeNone copies the field's value unescaped. This is the default
+	// for fields that don't carry arbitrary client-supplied text.
+	escapeNone escapeMode = iota
+
+	// escapeDefault uses nginx's log_format escaping: \xXX (uppercase
+	// hex) for control and DEL bytes, plus \" and \\. This is the
+	// default for header and URI-derived fields.
+	escapeDefault
+
+	// escapeJSON uses RFC 8259 JSON string escaping (without the
+	// surrounding quotes, since the field is embedded in a
+	// non-JSON pattern line): \uXXXX for control bytes, plus the usual
+	// short escapes, \" and \\.
+	escapeJSON
+)
+
+// parseEscapeMode parses the ":mode" suffix recognized by parse(). An empty
+// string selects escapeDefault, matching the fallback used when a field is
+// given no explicit mode but defaults to escaping (see fieldEscapeMode).
+func parseEscapeMode(s string) (escapeMode, error) {
+	switch s {
+	case "", "default":
+		return escapeDefault, nil
+	case "json":
+		return escapeJSON, nil
+	case "none":
+		return escapeNone, nil
+	default:
+		return escapeNone, fmt.Errorf("invalid escape mode %q", s)
+	}
+}
+
+// escScratchPool recycles the scratch buffers wrapEscape renders a field's
+// unescaped value into before escaping it onto the real output buffer, so
+// that escaping doesn't add allocations to the hot path.
+var escScratchPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+// wrapEscape wraps fn so that its output is escaped according to mode
+// before being appended to *b. escapeNone returns fn unchanged so that
+// fields without an escaping mode keep their original, allocation-free
+// behavior.
+func wrapEscape(fn field, mode escapeMode) field {
+	if mode == escapeNone {
+		return fn
+	}
+
+	appendEscaped := appendEscapeDefault
+	if mode == escapeJSON {
+		appendEscaped = appendEscapeJSON
+	}
+
+	return func(b *[]byte, ev *LogEvent) {
+		sp := escScratchPool.Get().(*[]byte)
+		*sp = (*sp)[:0]
+		fn(sp, ev)
+		*b = appendEscaped(*b, *sp)
+		escScratchPool.Put(sp)
+	}
+}
+
+const hexDigitsUpper = "0123456789ABCDEF"
+
+// appendEscapeDefault appends src to dst, escaping it the way nginx's
+// log_format directive does: \" and \\ for the characters that would
+// otherwise break a quoted field, and \xXX for control and DEL bytes so
+// that a header or URI containing them can't inject newlines or terminal
+// escape sequences into the log.
+func appendEscapeDefault(dst, src []byte) []byte {
+	for _, c := range src {
+		switch {
+		case c == '"':
+			dst = append(dst, '\\', '"')
+		case c == '\\':
+			dst = append(dst, '\\', '\\')
+		case c < 0x20 || c == 0x7f:
+			dst = append(dst, '\\', 'x', hexDigitsUpper[c>>4], hexDigitsUpper[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// appendEscapeJSON appends src to dst using RFC 8259 string escaping,
+// without the surrounding quotes, mirroring writeJSONString in json.go.
+func appendEscapeJSON(dst, src []byte) []byte {
+	for _, c := range src {
+		switch {
+		case c == '"':
+			dst = append(dst, '\\', '"')
+		case c == '\\':
+			dst = append(dst, '\\', '\\')
+		case c == '\n':
+			dst = append(dst, '\\', 'n')
+		case c == '\r':
+			dst = append(dst, '\\', 'r')
+		case c == '\t':
+			dst = append(dst, '\\', 't')
+		case c < 0x20:
+			dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LogEvent carries everything a field func needs to render one log line.
+// Using a struct instead of a growing list of Log() parameters lets fields
+// such as upstream timing or TLS info be added without changing the
+// Logger interface every time.
+type LogEvent struct {
+	// Start and End bound the time the proxy spent handling the request,
+	// from accepting it to the response being written to the client.
+	Start, End time.Time
+
+	// Request is the client request. Response is the (possibly
+	// rewritten) response sent back to the client.
+	Request  *http.Request
+	Response *http.Response
+
+	// RequestLength is the number of bytes read from the client for this
+	// request, including the request line and headers.
+	RequestLength int64
+
+	// UpstreamStart and UpstreamEnd bound the proxy's round-trip to the
+	// upstream server, which can be narrower than Start/End when the
+	// proxy does additional work - buffering, compression, ... - around
+	// the upstream call.
+	UpstreamStart, UpstreamEnd time.Time
+
+	// UpstreamConnectStart and UpstreamConnectEnd bound the time spent
+	// establishing the connection to the upstream server.
+	UpstreamConnectStart, UpstreamConnectEnd time.Time
+
+	// UpstreamStatus is the status code returned by the upstream server,
+	// which can differ from Response.StatusCode when the proxy rewrites
+	// it before sending the response to the client.
+	UpstreamStatus int
+}
+
+// evPool recycles the *LogEvent values Log renders from. Field funcs take
+// *LogEvent so that the (fairly wide) struct isn't copied on every call in
+// pattern.write's hot loop; pooling it rather than taking the address of a
+// fresh local avoids forcing that local to escape to the heap, the same
+// reasoning bufPool applies to the render buffer in pattern.go.
+var evPool = sync.Pool{
+	New: func() interface{} { return new(LogEvent) },
+}
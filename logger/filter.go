@@ -0,0 +1,186 @@
+package logger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// predicate decides whether a request should be logged.
+type predicate func(ev *LogEvent) bool
+
+// compilePredicate compiles a boolean expression over the same $field
+// vocabulary the pattern parser understands, e.g.
+//
+//	$response_status >= 400
+//	$response_time_ms > 500 && $response_status >= 500
+//
+// into a predicate that is evaluated once per request instead of
+// re-parsing the expression every time. Clauses may be combined with && or
+// || but the two cannot be mixed in the same expression. The scope is
+// deliberately narrow: each clause compares one field against a numeric
+// literal (see compileClause); there is no support for string literals,
+// parentheses or operator precedence.
+func compilePredicate(expr string, fields map[string]field) (predicate, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+
+	op, parts := "&&", strings.Split(expr, "&&")
+	if len(parts) == 1 {
+		op, parts = "||", strings.Split(expr, "||")
+	}
+
+	clauses := make([]predicate, len(parts))
+	for i, p := range parts {
+		c, err := compileClause(strings.TrimSpace(p), fields)
+		if err != nil {
+			return nil, err
+		}
+		clauses[i] = c
+	}
+
+	if op == "||" {
+		return func(ev *LogEvent) bool {
+			for _, c := range clauses {
+				if c(ev) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return func(ev *LogEvent) bool {
+		for _, c := range clauses {
+			if !c(ev) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compareOps lists the comparison operators compileClause recognizes, in
+// longest-match-first order so that ">=" is not cut short as ">".
+var compareOps = []string{">=", "<=", "!=", "==", ">", "<"}
+
+// filterScratchPool recycles the scratch buffers compileClause's predicate
+// renders a field's value into before parsing it, mirroring bufPool and
+// escScratchPool so that a configured If clause costs no allocations at
+// steady state.
+var filterScratchPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 32)
+		return &b
+	},
+}
+
+// compileClause compiles a single "$field OP value" comparison into a
+// predicate. value must parse as a float64, so only numeric fields (status
+// codes, durations, byte counts, and the like) can be filtered on; the
+// field is rendered with its existing field func and parsed back the same
+// way, which keeps this in sync with the pattern vocabulary without
+// duplicating it.
+func compileClause(s string, fields map[string]field) (predicate, error) {
+	for _, op := range compareOps {
+		i := strings.Index(s, op)
+		if i < 0 {
+			continue
+		}
+		name := strings.TrimSpace(s[:i])
+		rhs := strings.TrimSpace(s[i+len(op):])
+
+		f := fields[name]
+		if f == nil {
+			return nil, fmt.Errorf("logger: invalid field %q in predicate %q", name, s)
+		}
+		want, err := strconv.ParseFloat(rhs, 64)
+		if err != nil {
+			return nil, fmt.Errorf("logger: invalid value %q in predicate %q", rhs, s)
+		}
+		cmp := compareFunc(op)
+
+		return func(ev *LogEvent) bool {
+			sp := filterScratchPool.Get().(*[]byte)
+			*sp = (*sp)[:0]
+			f(sp, ev)
+			got, err := strconv.ParseFloat(string(*sp), 64)
+			filterScratchPool.Put(sp)
+			if err != nil {
+				return false
+			}
+			return cmp(got, want)
+		}, nil
+	}
+	return nil, fmt.Errorf("logger: invalid predicate %q", s)
+}
+
+func compareFunc(op string) func(a, b float64) bool {
+	switch op {
+	case ">=":
+		return func(a, b float64) bool { return a >= b }
+	case "<=":
+		return func(a, b float64) bool { return a <= b }
+	case "!=":
+		return func(a, b float64) bool { return a != b }
+	case "==":
+		return func(a, b float64) bool { return a == b }
+	case ">":
+		return func(a, b float64) bool { return a > b }
+	default: // "<"
+		return func(a, b float64) bool { return a < b }
+	}
+}
+
+// sampler allows every nth call through, deterministically. n <= 1 allows
+// every call.
+type sampler struct {
+	n   int64
+	hit int64
+}
+
+func newSampler(n int) *sampler {
+	return &sampler{n: int64(n)}
+}
+
+func (s *sampler) allow() bool {
+	if s.n <= 1 {
+		return true
+	}
+	return atomic.AddInt64(&s.hit, 1)%s.n == 0
+}
+
+// rateLimiter is a token-bucket limiter allowing up to perSecond events per
+// second, with a burst equal to one second worth of tokens.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{rate: float64(perSecond), tokens: float64(perSecond), last: time.Now()}
+}
+
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += l.rate * now.Sub(l.last).Seconds()
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,150 @@
+package logger
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeJSON renders a log entry as a single-line JSON object with typed
+// values - numbers for status/size/duration, an RFC3339 string for time and
+// a nested "headers" object - rather than the pre-formatted strings the
+// pattern renderer produces. This lets operators ship entries straight into
+// a log-aggregation pipeline without parsing an Apache-style line. Besides
+// the basic request/response fields it carries the TLS, scheme and
+// upstream-timing fields from tls.go and the request id. It does not carry
+// the request Host, the upstream address, host or port, or the dropped
+// entry count that the pattern renderer can print. requestIDHeader is the header
+// "request_id" reads from, with the same fallback to a generated id as the
+// "$request_id" pattern field.
+func writeJSON(b *bytes.Buffer, ev *LogEvent, requestIDHeader string) {
+	r, w := ev.Request, ev.Response
+
+	b.WriteByte('{')
+
+	writeJSONField(b, "time", true)
+	writeJSONString(b, ev.End.UTC().Format(time.RFC3339Nano))
+
+	writeJSONField(b, "remote_addr", false)
+	writeJSONString(b, r.RemoteAddr)
+
+	writeJSONField(b, "method", false)
+	writeJSONString(b, r.Method)
+
+	writeJSONField(b, "uri", false)
+	writeJSONString(b, r.RequestURI)
+
+	writeJSONField(b, "proto", false)
+	writeJSONString(b, r.Proto)
+
+	writeJSONField(b, "scheme", false)
+	writeJSONString(b, scheme(ev))
+
+	writeJSONField(b, "request_length", false)
+	b.WriteString(strconv.FormatInt(requestLength(ev), 10))
+
+	writeJSONField(b, "request_id", false)
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = genRequestID()
+	}
+	writeJSONString(b, id)
+
+	if r.TLS != nil {
+		writeJSONField(b, "ssl_protocol", false)
+		writeJSONString(b, tls.VersionName(r.TLS.Version))
+
+		writeJSONField(b, "ssl_cipher", false)
+		writeJSONString(b, tls.CipherSuiteName(r.TLS.CipherSuite))
+
+		writeJSONField(b, "ssl_server_name", false)
+		writeJSONString(b, r.TLS.ServerName)
+	}
+
+	if w != nil {
+		writeJSONField(b, "status", false)
+		b.WriteString(strconv.Itoa(w.StatusCode))
+
+		writeJSONField(b, "size", false)
+		b.WriteString(strconv.FormatInt(w.ContentLength, 10))
+	}
+
+	if ev.UpstreamStatus != 0 {
+		writeJSONField(b, "upstream_status", false)
+		b.WriteString(strconv.Itoa(ev.UpstreamStatus))
+	}
+
+	if !ev.UpstreamStart.IsZero() && !ev.UpstreamEnd.IsZero() {
+		writeJSONField(b, "upstream_response_time_ms", false)
+		b.WriteString(strconv.FormatFloat(float64(ev.UpstreamEnd.Sub(ev.UpstreamStart))/float64(time.Millisecond), 'f', -1, 64))
+	}
+
+	if !ev.UpstreamConnectStart.IsZero() && !ev.UpstreamConnectEnd.IsZero() {
+		writeJSONField(b, "upstream_connect_time_ms", false)
+		b.WriteString(strconv.FormatFloat(float64(ev.UpstreamConnectEnd.Sub(ev.UpstreamConnectStart))/float64(time.Millisecond), 'f', -1, 64))
+	}
+
+	writeJSONField(b, "duration_ms", false)
+	b.WriteString(strconv.FormatFloat(float64(ev.End.Sub(ev.Start))/float64(time.Millisecond), 'f', -1, 64))
+
+	writeJSONField(b, "headers", false)
+	b.WriteByte('{')
+	first := true
+	for k, v := range r.Header {
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		writeJSONString(b, k)
+		b.WriteByte(':')
+		writeJSONString(b, strings.Join(v, ", "))
+	}
+	b.WriteByte('}')
+
+	b.WriteByte('}')
+	b.WriteRune('\n')
+}
+
+// writeJSONField writes the ,"key": prefix shared by every JSON member. The
+// leading comma is omitted for the first member.
+func writeJSONField(b *bytes.Buffer, key string, first bool) {
+	if !first {
+		b.WriteByte(',')
+	}
+	writeJSONString(b, key)
+	b.WriteByte(':')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSONString writes s to b as an RFC 8259 JSON string, escaping
+// quotes, backslashes and control characters (as \uXXXX, using the short
+// escapes where they exist) so that values containing attacker-controlled
+// data such as headers cannot break out of the string or inject control
+// bytes into the log stream.
+func writeJSONString(b *bytes.Buffer, s string) {
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20:
+			b.WriteString(`\u00`)
+			b.WriteByte(hexDigits[(r>>4)&0xf])
+			b.WriteByte(hexDigits[r&0xf])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+}
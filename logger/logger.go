@@ -0,0 +1,180 @@
+// Package logger implements support for logging requests handled by the
+// proxy in various formats.
+package logger
+
+import (
+	"bytes"
+	"math"
+	"os"
+)
+
+// Logger logs a single request/response pair.
+type Logger interface {
+	Log(ev LogEvent)
+}
+
+// Format selects how a log entry is rendered.
+type Format int
+
+const (
+	// FormatPattern renders entries using the Apache-style $field pattern
+	// language implemented in pattern.go. This is the default.
+	FormatPattern Format = iota
+
+	// FormatJSON renders entries as one JSON object per line with typed
+	// values instead of pre-formatted strings.
+	FormatJSON
+)
+
+// Config configures a Logger created with New.
+type Config struct {
+	// Format selects the pattern or JSON renderer.
+	Format Format
+
+	// Pattern is the format string used when Format is FormatPattern. See
+	// parse() for the syntax.
+	Pattern string
+
+	// Sink receives the rendered log entries. Defaults to a Sink writing
+	// to os.Stdout.
+	Sink Sink
+
+	// Sample logs only 1 in Sample requests, deterministically. Values
+	// <= 1 log every request. Takes precedence over SamplePercent when
+	// both are set.
+	Sample int
+
+	// SamplePercent logs approximately this percentage of requests,
+	// converted to the nearest 1-in-N ratio and sampled the same
+	// deterministic way as Sample (e.g. 25 samples 1 in 4). Only used
+	// when Sample is <= 1. Values <= 0 or >= 100 log every request.
+	SamplePercent float64
+
+	// RateLimit caps the number of requests logged per second using a
+	// token bucket. Values <= 0 disable the limit.
+	RateLimit int
+
+	// If is a boolean expression over the $field vocabulary, e.g.
+	// "$response_status >= 400". Only requests matching it are logged.
+	// An empty expression logs every request. Clauses compare a field
+	// against a numeric literal with ==, !=, <, <=, > or >=, joined by a
+	// single && or || (the two cannot be mixed); there is no support for
+	// string literals, parentheses or quoting. See compilePredicate for
+	// the supported syntax.
+	If string
+
+	// Rotate, if set, writes entries through a non-blocking Rotater to
+	// rotating segment files under Rotate.Dir, and makes "$dropped_total"
+	// available in Pattern/If. Sink is not used when Rotate is set.
+	Rotate *RotateConfig
+
+	// RequestIDHeader names the header "$request_id" reads the request id
+	// from. Defaults to "X-Request-Id". An id is generated when the
+	// header is absent on a request.
+	RequestIDHeader string
+}
+
+type logger struct {
+	p    pattern
+	json bool
+	sink Sink
+
+	pred   predicate
+	sample *sampler
+	limit  *rateLimiter
+
+	requestIDHeader string
+}
+
+// New creates a Logger from cfg.
+func New(cfg Config) (Logger, error) {
+	sink := cfg.Sink
+	fieldTable := fields
+
+	if cfg.Rotate != nil {
+		rot := NewRotater(*cfg.Rotate)
+		sink = rot
+		fieldTable = withDroppedTotal(fieldTable, rot)
+	}
+	fieldTable = withTLSFields(fieldTable)
+	fieldTable = withRequestID(fieldTable, cfg.RequestIDHeader)
+
+	if sink == nil {
+		sink = WriterSink(os.Stdout)
+	}
+
+	requestIDHeader := cfg.RequestIDHeader
+	if requestIDHeader == "" {
+		requestIDHeader = requestIDHeaderDefault
+	}
+
+	l := &logger{sink: sink, requestIDHeader: requestIDHeader}
+
+	if cfg.Format == FormatJSON {
+		l.json = true
+	} else {
+		p, err := parse(cfg.Pattern, fieldTable)
+		if err != nil {
+			return nil, err
+		}
+		l.p = p
+	}
+
+	pred, err := compilePredicate(cfg.If, fieldTable)
+	if err != nil {
+		return nil, err
+	}
+	l.pred = pred
+
+	sample := cfg.Sample
+	if sample <= 1 && cfg.SamplePercent > 0 && cfg.SamplePercent < 100 {
+		sample = int(math.Round(100 / cfg.SamplePercent))
+	}
+	if sample > 1 {
+		l.sample = newSampler(sample)
+	}
+	if cfg.RateLimit > 0 {
+		l.limit = newRateLimiter(cfg.RateLimit)
+	}
+
+	return l, nil
+}
+
+// allow reports whether the request passes the configured sampling, rate
+// limit and predicate, in that order, so that a request most likely to be
+// filtered out is rejected by the cheapest check before paying for the
+// field-rendering cost of evaluating the predicate.
+func (l *logger) allow(ev *LogEvent) bool {
+	if l.sample != nil && !l.sample.allow() {
+		return false
+	}
+	if l.limit != nil && !l.limit.allow() {
+		return false
+	}
+	if l.pred != nil && !l.pred(ev) {
+		return false
+	}
+	return true
+}
+
+func (l *logger) Log(ev LogEvent) {
+	e := evPool.Get().(*LogEvent)
+	*e = ev
+
+	if !l.allow(e) {
+		evPool.Put(e)
+		return
+	}
+
+	if l.json {
+		var b bytes.Buffer
+		writeJSON(&b, e, l.requestIDHeader)
+		if b.Len() > 0 {
+			l.sink.Write(b.Bytes())
+		}
+		evPool.Put(e)
+		return
+	}
+	l.p.write(l.sink, e)
+	evPool.Put(e)
+}
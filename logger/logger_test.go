@@ -2,9 +2,13 @@ package logger
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -13,11 +17,11 @@ import (
 
 func TestParse(t *testing.T) {
 	fields := map[string]field{
-		"$a": func(b *bytes.Buffer, _, _ time.Time, _ *http.Response, _ *http.Request) {
-			b.WriteString("aa")
+		"$a": func(b *[]byte, _ *LogEvent) {
+			*b = append(*b, "aa"...)
 		},
-		"$b": func(b *bytes.Buffer, _, _ time.Time, _ *http.Response, _ *http.Request) {
-			b.WriteString("bb")
+		"$b": func(b *[]byte, _ *LogEvent) {
+			*b = append(*b, "bb"...)
 		},
 	}
 	req := &http.Request{
@@ -43,7 +47,7 @@ func TestParse(t *testing.T) {
 			continue
 		}
 		var b bytes.Buffer
-		p.write(&b, time.Time{}, time.Time{}, nil, req)
+		p.write(&b, &LogEvent{Request: req})
 		if got, want := string(b.Bytes()), tt.out; got != want {
 			t.Errorf("%d: got %q want %q", i, got, want)
 		}
@@ -119,12 +123,12 @@ func TestLog(t *testing.T) {
 		t.Run(tt.format, func(t *testing.T) {
 			b := new(bytes.Buffer)
 
-			l, err := New(b, tt.format)
+			l, err := New(Config{Sink: WriterSink(b), Pattern: tt.format})
 			if err != nil {
 				t.Fatalf("got %v want nil", err)
 			}
 
-			l.Log(t1, t2, resp, req)
+			l.Log(LogEvent{Start: t1, End: t2, Response: resp, Request: req})
 			if got, want := string(b.Bytes()), tt.out; got != want {
 				t.Errorf("got %q want %q", got, want)
 			}
@@ -132,7 +136,326 @@ func TestLog(t *testing.T) {
 	}
 }
 
-func TestAtoi(t *testing.T) {
+func TestLogJSON(t *testing.T) {
+	t1 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(123456789 * time.Nanosecond)
+
+	req := &http.Request{
+		RequestURI: "/?q=x",
+		Header:     http.Header{"User-Agent": {"Mozilla Firefox"}},
+		RemoteAddr: "2.2.2.2:666",
+		Method:     "GET",
+		Proto:      "HTTP/1.1",
+	}
+	resp := &http.Response{StatusCode: 200, ContentLength: 1234}
+
+	b := new(bytes.Buffer)
+	l, err := New(Config{Format: FormatJSON, Sink: WriterSink(b)})
+	if err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+
+	l.Log(LogEvent{Start: t1, End: t2, Response: resp, Request: req})
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", b.String(), err)
+	}
+	want := map[string]interface{}{
+		"time":           "2016-01-01T00:00:00.123456789Z",
+		"remote_addr":    "2.2.2.2:666",
+		"method":         "GET",
+		"uri":            "/?q=x",
+		"proto":          "HTTP/1.1",
+		"scheme":         "http",
+		"request_length": float64(51),
+		"status":         float64(200),
+		"size":           float64(1234),
+		"duration_ms":    123.456789,
+		"headers":        map[string]interface{}{"User-Agent": "Mozilla Firefox"},
+	}
+	id, _ := got["request_id"].(string)
+	if id == "" {
+		t.Errorf("got empty request_id")
+	}
+	delete(got, "request_id")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v want %#v", got, want)
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	t1 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Millisecond)
+	req := &http.Request{RequestURI: "/", Method: "GET"}
+
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{200, ""},
+		{404, "404\n"},
+		{500, "500\n"},
+	}
+
+	b := new(bytes.Buffer)
+	l, err := New(Config{Pattern: "$response_status", Sink: WriterSink(b), If: "$response_status >= 400"})
+	if err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+
+	for _, tt := range tests {
+		b.Reset()
+		l.Log(LogEvent{Start: t1, End: t2, Response: &http.Response{StatusCode: tt.status}, Request: req})
+		if got := b.String(); got != tt.want {
+			t.Errorf("status %d: got %q want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := newSampler(3)
+	var got []bool
+	for i := 0; i < 6; i++ {
+		got = append(got, s.allow())
+	}
+	want := []bool{false, false, true, false, false, true}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("call %d: got %v want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLogSamplePercent(t *testing.T) {
+	req := &http.Request{RequestURI: "/", Method: "GET"}
+	resp := &http.Response{StatusCode: 200}
+
+	b := new(bytes.Buffer)
+	l, err := New(Config{Pattern: "$request_uri", Sink: WriterSink(b), SamplePercent: 25})
+	if err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+
+	var got []bool
+	for i := 0; i < 8; i++ {
+		b.Reset()
+		l.Log(LogEvent{Request: req, Response: resp})
+		got = append(got, b.Len() > 0)
+	}
+	want := []bool{false, false, false, true, false, false, false, true}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("call %d: got %v want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRotaterDrop(t *testing.T) {
+	// Construct the Rotater without starting its background goroutine so
+	// the queue fills up deterministically.
+	r := &Rotater{queue: make(chan []byte, 1)}
+	r.Write([]byte("a"))
+	r.Write([]byte("b"))
+	r.Write([]byte("c"))
+	if got, want := r.Dropped(), int64(2); got != want {
+		t.Errorf("got %d dropped want %d", got, want)
+	}
+}
+
+func TestRotaterCloseFlushesQueue(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRotater(RotateConfig{Dir: dir, Prefix: "access"})
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		r.Write([]byte("line\n"))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "access-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int
+	for _, m := range matches {
+		b, err := ioutil.ReadFile(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += bytes.Count(b, []byte("line\n"))
+	}
+	if total != n {
+		t.Errorf("got %d lines written want %d", total, n)
+	}
+}
+
+func TestLogTLSAndUpstreamFields(t *testing.T) {
+	req := &http.Request{
+		RequestURI: "/",
+		Method:     "GET",
+		Header:     http.Header{"Upgrade": {"websocket"}},
+		TLS: &tls.ConnectionState{
+			Version:     tls.VersionTLS13,
+			CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+			ServerName:  "example.com",
+		},
+	}
+	resp := &http.Response{StatusCode: 200}
+
+	tests := []struct {
+		format string
+		out    string
+	}{
+		{"$scheme", "wss\n"},
+		{"$ssl_protocol", "TLS 1.3\n"},
+		{"$ssl_cipher", "TLS_AES_128_GCM_SHA256\n"},
+		{"$ssl_server_name", "example.com\n"},
+		{"$upstream_status", "502\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			l, err := New(Config{Pattern: tt.format, Sink: WriterSink(b)})
+			if err != nil {
+				t.Fatalf("got %v want nil", err)
+			}
+			l.Log(LogEvent{Request: req, Response: resp, UpstreamStatus: 502})
+			if got := b.String(); got != tt.out {
+				t.Errorf("got %q want %q", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestLogJSONTLSAndUpstreamFields(t *testing.T) {
+	req := &http.Request{
+		RequestURI: "/",
+		Method:     "GET",
+		TLS: &tls.ConnectionState{
+			Version:     tls.VersionTLS13,
+			CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+			ServerName:  "example.com",
+		},
+	}
+	resp := &http.Response{StatusCode: 200}
+
+	b := new(bytes.Buffer)
+	l, err := New(Config{Format: FormatJSON, Sink: WriterSink(b)})
+	if err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+	l.Log(LogEvent{Request: req, Response: resp, UpstreamStatus: 502})
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", b.String(), err)
+	}
+	want := map[string]interface{}{
+		"scheme":          "https",
+		"ssl_protocol":    "TLS 1.3",
+		"ssl_cipher":      "TLS_AES_128_GCM_SHA256",
+		"ssl_server_name": "example.com",
+		"upstream_status": float64(502),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("field %q: got %#v want %#v", k, got[k], v)
+		}
+	}
+}
+
+func TestLogRequestID(t *testing.T) {
+	resp := &http.Response{StatusCode: 200}
+
+	t.Run("from header", func(t *testing.T) {
+		req := &http.Request{Header: http.Header{"X-Request-Id": {"abc-123"}}}
+		b := new(bytes.Buffer)
+		l, err := New(Config{Pattern: "$request_id", Sink: WriterSink(b)})
+		if err != nil {
+			t.Fatalf("got %v want nil", err)
+		}
+		l.Log(LogEvent{Request: req, Response: resp})
+		if got, want := b.String(), "abc-123\n"; got != want {
+			t.Errorf("got %q want %q", got, want)
+		}
+	})
+
+	t.Run("generated when absent", func(t *testing.T) {
+		req := &http.Request{Header: http.Header{}}
+		b := new(bytes.Buffer)
+		l, err := New(Config{Pattern: "$request_id", Sink: WriterSink(b)})
+		if err != nil {
+			t.Fatalf("got %v want nil", err)
+		}
+		l.Log(LogEvent{Request: req, Response: resp})
+		if got := b.String(); len(got) != len("0123456789abcdef0123456789abcdef")+1 {
+			t.Errorf("got %q want a 32-char hex id", got)
+		}
+	})
+
+	t.Run("custom header", func(t *testing.T) {
+		req := &http.Request{Header: http.Header{"X-Trace-Id": {"xyz"}}}
+		b := new(bytes.Buffer)
+		l, err := New(Config{Pattern: "$request_id", Sink: WriterSink(b), RequestIDHeader: "X-Trace-Id"})
+		if err != nil {
+			t.Fatalf("got %v want nil", err)
+		}
+		l.Log(LogEvent{Request: req, Response: resp})
+		if got, want := b.String(), "xyz\n"; got != want {
+			t.Errorf("got %q want %q", got, want)
+		}
+	})
+}
+
+func TestLogEscaping(t *testing.T) {
+	req := &http.Request{
+		RequestURI: "/a\"b\\c\x01d",
+		Method:     "GET",
+		Header:     http.Header{"X-Evil": {"v\"a\\l\nue"}, "X-Request-Id": {"v\"a\\l\nue"}},
+		TLS:        &tls.ConnectionState{ServerName: "v\"a\\l\nue"},
+	}
+	resp := &http.Response{StatusCode: 200}
+
+	tests := []struct {
+		format string
+		out    string
+	}{
+		{"$request_uri", `/a\"b\\c\x01d` + "\n"},
+		{"$request_uri:default", `/a\"b\\c\x01d` + "\n"},
+		{"$request_uri:none", "/a\"b\\c\x01d\n"},
+		{"$request_uri:json", `/a\"b\\c\u0001d` + "\n"},
+		{"$header.X-Evil", `v\"a\\l\x0Aue` + "\n"},
+		{"$header.X-Evil:json", `v\"a\\l\nue` + "\n"},
+		{"$request_id", `v\"a\\l\x0Aue` + "\n"},
+		{"$request_id:none", "v\"a\\l\nue\n"},
+		{"$ssl_server_name", `v\"a\\l\x0Aue` + "\n"},
+		{"$ssl_server_name:none", "v\"a\\l\nue\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			l, err := New(Config{Pattern: tt.format, Sink: WriterSink(b)})
+			if err != nil {
+				t.Fatalf("got %v want nil", err)
+			}
+			l.Log(LogEvent{Request: req, Response: resp})
+			if got := b.String(); got != tt.out {
+				t.Errorf("got %q want %q", got, tt.out)
+			}
+		})
+	}
+
+	if _, err := parse("$response_status:bogus", fields); err == nil {
+		t.Error("got nil, want error for invalid escape mode")
+	}
+}
+
+func TestAppendInt(t *testing.T) {
 	tests := []struct {
 		i   int64
 		pad int
@@ -156,14 +479,62 @@ func TestAtoi(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		var b bytes.Buffer
-		atoi(&b, tt.i, tt.pad)
-		if got, want := string(b.Bytes()), tt.s; got != want {
-			t.Errorf("%d: got %q want %q", i, got, want)
+		got := appendInt(nil, tt.i, tt.pad)
+		if string(got) != tt.s {
+			t.Errorf("%d: got %q want %q", i, string(got), tt.s)
 		}
 	}
 }
 
+func TestLogAllocs(t *testing.T) {
+	t1 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(100 * time.Millisecond)
+	req := &http.Request{
+		RequestURI: "/?q=x",
+		Header: http.Header{
+			"User-Agent":      {"Mozilla Firefox"},
+			"Referer":         {"http://foo.com/"},
+			"X-Forwarded-For": {"3.3.3.3"},
+		},
+		RemoteAddr: "2.2.2.2:666",
+		Host:       "foo.com",
+		URL: &url.URL{
+			Path:     "/",
+			RawQuery: "?q=x",
+			Host:     "proxy host",
+		},
+		Method: "GET",
+		Proto:  "HTTP/1.1",
+	}
+	resp := &http.Response{
+		StatusCode:    200,
+		ContentLength: 1234,
+		Header:        http.Header{"foo": []string{"bar"}},
+		Request: &http.Request{
+			RemoteAddr: "5.6.7.8:1234",
+		},
+	}
+
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	format := strings.Join(keys, " ")
+
+	l, err := New(Config{Pattern: format, Sink: WriterSink(ioutil.Discard)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		l.Log(LogEvent{Start: t1, End: t2, Response: resp, Request: req})
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocs/run for full-field format, want 0", allocs)
+	}
+}
+
 func BenchmarkLog(b *testing.B) {
 	t1 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
 	t2 := t1.Add(100 * time.Millisecond)
@@ -201,12 +572,12 @@ func BenchmarkLog(b *testing.B) {
 	sort.Strings(keys)
 	format := strings.Join(keys, " ")
 
-	l, err := New(ioutil.Discard, format)
+	l, err := New(Config{Sink: WriterSink(ioutil.Discard), Pattern: format})
 	if err != nil {
 		b.Fatal(err)
 	}
 
 	for i := 0; i < b.N; i++ {
-		l.Log(t1, t2, resp, req)
+		l.Log(LogEvent{Start: t1, End: t2, Response: resp, Request: req})
 	}
 }
@@ -0,0 +1,29 @@
+package logger
+
+// appendInt appends the decimal representation of i to b, zero-padding it
+// on the left so that it is at least pad digits wide (not counting a
+// leading '-'), and returns the extended slice. It does not allocate as
+// long as b has spare capacity, which is what makes the date/time fields in
+// pattern.go allocation-free at steady state; fields that don't need
+// padding use strconv.AppendInt directly instead.
+func appendInt(b []byte, i int64, pad int) []byte {
+	if i < 0 {
+		b = append(b, '-')
+		i = -i
+	}
+
+	var tmp [20]byte
+	n := len(tmp)
+	for i >= 10 {
+		n--
+		tmp[n] = byte(i%10) + '0'
+		i /= 10
+	}
+	n--
+	tmp[n] = byte(i) + '0'
+
+	for w := len(tmp) - n; w < pad; w++ {
+		b = append(b, '0')
+	}
+	return append(b, tmp[n:]...)
+}
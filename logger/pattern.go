@@ -1,27 +1,47 @@
 package logger
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"net"
-	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-// field renders a part of the log line.
-type field func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request)
+// field renders a part of the log line by appending to *b and returning the
+// extended slice through it. The field functions must not allocate on the
+// steady-state path: use strconv.AppendInt/appendInt and append(*b, s...)
+// instead of fmt.Sprintf or bytes.Buffer.
+type field func(b *[]byte, ev *LogEvent)
 
 // Pattern is a log output format.
 type pattern []field
 
-func (p pattern) write(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
+// bufPool recycles the []byte buffers pattern.write renders into, so that a
+// given format has no allocations at steady state once the pool has warmed
+// up and the buffer has grown to fit the format's widest output.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+func (p pattern) write(w io.Writer, ev *LogEvent) {
+	bp := bufPool.Get().(*[]byte)
+	*bp = (*bp)[:0]
+
 	for _, fn := range p {
-		fn(b, t1, t2, w, r)
+		fn(bp, ev)
 	}
-	if b.Len() == 0 {
-		return
+	if len(*bp) > 0 {
+		*bp = append(*bp, '\n')
+		w.Write(*bp)
 	}
-	b.WriteRune('\n')
+
+	bufPool.Put(bp)
 }
 
 // parse parses a format string into a pattern based on the following rules:
@@ -29,20 +49,29 @@ func (p pattern) write(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *h
 // The format string consists of text and fields. Field names start with a '$'
 // and consist of ASCII characters [a-zA-Z0-9.-_]. Field names like
 // '$header.name' will render the HTTP header 'name'. All other field names
-// must exist in the fields map.
+// must exist in the fields map. A field or header name may be followed by
+// ':mode' (e.g. '$request_uri:json') to select how its rendered value is
+// escaped - 'default' (nginx-style), 'json' or 'none' - see escape.go. A
+// field given no ':mode' suffix falls back to fieldEscapeMode's default,
+// which escapes header and URI-derived fields and leaves everything else
+// untouched.
 func parse(format string, fields map[string]field) (p pattern, err error) {
-	// text is a helper to add raw text to the log output.
+	// text is a helper to add raw text to the log output. The string is
+	// converted to a []byte once, at parse time, so the field func itself
+	// never touches the string representation.
 	text := func(s string) field {
-		return func(b *bytes.Buffer, _, _ time.Time, _ *http.Response, _ *http.Request) {
-			b.WriteString(s)
+		lit := []byte(s)
+		return func(b *[]byte, _ *LogEvent) {
+			*b = append(*b, lit...)
 		}
 	}
 
 	// header is a helper to add an HTTP header to the log output.
-	header := func(name string) field {
-		return func(b *bytes.Buffer, _, _ time.Time, _ *http.Response, r *http.Request) {
-			b.WriteString(r.Header.Get(name))
+	header := func(name string, mode escapeMode) field {
+		fn := func(b *[]byte, ev *LogEvent) {
+			*b = append(*b, ev.Request.Header.Get(name)...)
 		}
+		return wrapEscape(fn, mode)
 	}
 
 	s := []rune(format)
@@ -57,23 +86,73 @@ func parse(format string, fields map[string]field) (p pattern, err error) {
 		case itemText:
 			p = append(p, text(val))
 		case itemHeader:
-			p = append(p, header(val[len("$header."):]))
+			name, modeStr := splitFieldMode(val[len("$header."):])
+			mode, err := resolveEscapeMode(modeStr, escapeDefault)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, header(name, mode))
 		case itemField:
-			f := fields[val]
+			name, modeStr := splitFieldMode(val)
+			f := fields[name]
 			if f == nil {
-				return nil, fmt.Errorf("invalid field %q", val)
+				return nil, fmt.Errorf("invalid field %q", name)
+			}
+			mode, err := resolveEscapeMode(modeStr, fieldEscapeMode(name))
+			if err != nil {
+				return nil, err
 			}
-			p = append(p, f)
+			p = append(p, wrapEscape(f, mode))
 		}
 	}
 	return p, nil
 }
 
+// splitFieldMode splits "name:mode" into its name and mode parts. mode is
+// "" when s carries no ":mode" suffix.
+func splitFieldMode(s string) (name, mode string) {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// resolveEscapeMode parses modeStr into an escapeMode, falling back to def
+// when the field carries no explicit ":mode" suffix.
+func resolveEscapeMode(modeStr string, def escapeMode) (escapeMode, error) {
+	if modeStr == "" {
+		return def, nil
+	}
+	return parseEscapeMode(modeStr)
+}
+
+// uriDerivedFields lists the fields whose value is taken directly from the
+// client-supplied request line, headers or TLS server name and therefore defaults to
+// escapeDefault rather than escapeNone. Header fields always default to
+// escapeDefault; see parse's itemHeader case.
+var uriDerivedFields = map[string]bool{
+	"$request":         true,
+	"$request_uri":     true,
+	"$request_args":    true,
+	"$request_host":    true,
+	"$request_id":      true,
+	"$ssl_server_name": true,
+}
+
+// fieldEscapeMode returns the escaping mode a field with no explicit
+// ":mode" suffix uses.
+func fieldEscapeMode(name string) escapeMode {
+	if uriDerivedFields[name] {
+		return escapeDefault
+	}
+	return escapeNone
+}
+
 // fields contains the known log fields and their field functions. The field
 // functions should avoid to alloc memory at all cost since they are in the hot
-// path. Do not use fmt.Sprintf() but combine the value from the parts. Instead
-// of strconv.Atoi/FormatInt() use the local atoi() function which does not
-// alloc.
+// path. Do not use fmt.Sprintf() but combine the value from the parts. Use
+// strconv.AppendInt() directly for plain integers and the local appendInt()
+// helper when zero-padding is required.
 var shortMonthNames = []string{
 	"---",
 	"Jan",
@@ -91,171 +170,177 @@ var shortMonthNames = []string{
 }
 
 var fields = map[string]field{
-	"$remote_addr": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		b.WriteString(r.RemoteAddr)
+	"$remote_addr": func(b *[]byte, ev *LogEvent) {
+		*b = append(*b, ev.Request.RemoteAddr...)
 	},
-	"$remote_host": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		host, _, _ := net.SplitHostPort(r.RemoteAddr)
-		b.WriteString(host)
+	"$remote_host": func(b *[]byte, ev *LogEvent) {
+		host, _, _ := net.SplitHostPort(ev.Request.RemoteAddr)
+		*b = append(*b, host...)
 	},
-	"$remote_port": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		_, port, _ := net.SplitHostPort(r.RemoteAddr)
-		b.WriteString(port)
+	"$remote_port": func(b *[]byte, ev *LogEvent) {
+		_, port, _ := net.SplitHostPort(ev.Request.RemoteAddr)
+		*b = append(*b, port...)
 	},
-	"$request": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		b.WriteString(r.Method)
-		b.WriteRune(' ')
-		b.WriteString(r.RequestURI)
-		b.WriteRune(' ')
-		b.WriteString(r.Proto)
+	"$request": func(b *[]byte, ev *LogEvent) {
+		r := ev.Request
+		*b = append(*b, r.Method...)
+		*b = append(*b, ' ')
+		*b = append(*b, r.RequestURI...)
+		*b = append(*b, ' ')
+		*b = append(*b, r.Proto...)
 	},
-	"$request_args": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		b.WriteString(r.URL.RawQuery)
+	"$request_args": func(b *[]byte, ev *LogEvent) {
+		*b = append(*b, ev.Request.URL.RawQuery...)
 	},
-	"$request_host": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		b.WriteString(r.Host)
+	"$request_host": func(b *[]byte, ev *LogEvent) {
+		*b = append(*b, ev.Request.Host...)
 	},
-	"$request_method": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		b.WriteString(r.Method)
+	"$request_method": func(b *[]byte, ev *LogEvent) {
+		*b = append(*b, ev.Request.Method...)
 	},
-	"$request_uri": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		b.WriteString(r.RequestURI)
+	"$request_uri": func(b *[]byte, ev *LogEvent) {
+		*b = append(*b, ev.Request.RequestURI...)
 	},
-	"$request_proto": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		b.WriteString(r.Proto)
+	"$request_proto": func(b *[]byte, ev *LogEvent) {
+		*b = append(*b, ev.Request.Proto...)
 	},
-	"$response_body_size": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, w.ContentLength, 0)
+	"$response_body_size": func(b *[]byte, ev *LogEvent) {
+		*b = strconv.AppendInt(*b, ev.Response.ContentLength, 10)
 	},
-	"$response_status": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, int64(w.StatusCode), 0)
+	"$response_status": func(b *[]byte, ev *LogEvent) {
+		*b = strconv.AppendInt(*b, int64(ev.Response.StatusCode), 10)
 	},
-	"$response_time_ms": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		d := t2.Sub(t1).Nanoseconds()
+	"$response_time_ms": func(b *[]byte, ev *LogEvent) {
+		d := ev.End.Sub(ev.Start).Nanoseconds()
 		s, µs := d/int64(time.Second), d%int64(time.Second)/int64(time.Millisecond)
-		atoi(b, s, 0)
-		b.WriteRune('.')
-		atoi(b, µs, 3)
+		*b = strconv.AppendInt(*b, s, 10)
+		*b = append(*b, '.')
+		*b = appendInt(*b, µs, 3)
 	},
-	"$response_time_us": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		d := t2.Sub(t1).Nanoseconds()
+	"$response_time_us": func(b *[]byte, ev *LogEvent) {
+		d := ev.End.Sub(ev.Start).Nanoseconds()
 		s, µs := d/int64(time.Second), d%int64(time.Second)/int64(time.Microsecond)
-		atoi(b, s, 0)
-		b.WriteRune('.')
-		atoi(b, µs, 6)
+		*b = strconv.AppendInt(*b, s, 10)
+		*b = append(*b, '.')
+		*b = appendInt(*b, µs, 6)
 	},
-	"$response_time_ns": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		d := t2.Sub(t1).Nanoseconds()
+	"$response_time_ns": func(b *[]byte, ev *LogEvent) {
+		d := ev.End.Sub(ev.Start).Nanoseconds()
 		s, ns := d/int64(time.Second), d%int64(time.Second)/int64(time.Nanosecond)
-		atoi(b, s, 0)
-		b.WriteRune('.')
-		atoi(b, ns, 9)
+		*b = strconv.AppendInt(*b, s, 10)
+		*b = append(*b, '.')
+		*b = appendInt(*b, ns, 9)
 	},
-	"$time_unix_ms": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, t2.UnixNano()/int64(time.Millisecond), 0)
+	"$time_unix_ms": func(b *[]byte, ev *LogEvent) {
+		*b = strconv.AppendInt(*b, ev.End.UnixNano()/int64(time.Millisecond), 10)
 	},
-	"$time_unix_us": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, t2.UnixNano()/int64(time.Microsecond), 0)
+	"$time_unix_us": func(b *[]byte, ev *LogEvent) {
+		*b = strconv.AppendInt(*b, ev.End.UnixNano()/int64(time.Microsecond), 10)
 	},
-	"$time_unix_ns": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, t2.UnixNano(), 0)
+	"$time_unix_ns": func(b *[]byte, ev *LogEvent) {
+		*b = strconv.AppendInt(*b, ev.End.UnixNano(), 10)
 	},
-	"$time_common": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, int64(t2.Day()), 2)
-		b.WriteRune('/')
-		b.WriteString(shortMonthNames[t2.Month()])
-		b.WriteRune('/')
-		atoi(b, int64(t2.Year()), 4)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Hour()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Minute()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Second()), 2)
-		b.WriteString(" +0000") // TODO(fs): local time
+	"$time_common": func(b *[]byte, ev *LogEvent) {
+		t2 := ev.End
+		*b = appendInt(*b, int64(t2.Day()), 2)
+		*b = append(*b, '/')
+		*b = append(*b, shortMonthNames[t2.Month()]...)
+		*b = append(*b, '/')
+		*b = appendInt(*b, int64(t2.Year()), 4)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Hour()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Minute()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Second()), 2)
+		*b = append(*b, " +0000"...) // TODO(fs): local time
 	},
-	"$time_rfc3339": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, int64(t2.Year()), 4)
-		b.WriteRune('-')
-		atoi(b, int64(t2.Month()), 2)
-		b.WriteRune('-')
-		atoi(b, int64(t2.Day()), 2)
-		b.WriteRune('T')
-		atoi(b, int64(t2.Hour()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Minute()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Second()), 2)
-		b.WriteRune('Z')
+	"$time_rfc3339": func(b *[]byte, ev *LogEvent) {
+		t2 := ev.End
+		*b = appendInt(*b, int64(t2.Year()), 4)
+		*b = append(*b, '-')
+		*b = appendInt(*b, int64(t2.Month()), 2)
+		*b = append(*b, '-')
+		*b = appendInt(*b, int64(t2.Day()), 2)
+		*b = append(*b, 'T')
+		*b = appendInt(*b, int64(t2.Hour()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Minute()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Second()), 2)
+		*b = append(*b, 'Z')
 	},
-	"$time_rfc3339_ms": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, int64(t2.Year()), 4)
-		b.WriteRune('-')
-		atoi(b, int64(t2.Month()), 2)
-		b.WriteRune('-')
-		atoi(b, int64(t2.Day()), 2)
-		b.WriteRune('T')
-		atoi(b, int64(t2.Hour()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Minute()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Second()), 2)
-		b.WriteRune('.')
-		atoi(b, int64(t2.Nanosecond())/int64(time.Millisecond), 3)
-		b.WriteRune('Z')
+	"$time_rfc3339_ms": func(b *[]byte, ev *LogEvent) {
+		t2 := ev.End
+		*b = appendInt(*b, int64(t2.Year()), 4)
+		*b = append(*b, '-')
+		*b = appendInt(*b, int64(t2.Month()), 2)
+		*b = append(*b, '-')
+		*b = appendInt(*b, int64(t2.Day()), 2)
+		*b = append(*b, 'T')
+		*b = appendInt(*b, int64(t2.Hour()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Minute()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Second()), 2)
+		*b = append(*b, '.')
+		*b = appendInt(*b, int64(t2.Nanosecond())/int64(time.Millisecond), 3)
+		*b = append(*b, 'Z')
 	},
-	"$time_rfc3339_us": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, int64(t2.Year()), 4)
-		b.WriteRune('-')
-		atoi(b, int64(t2.Month()), 2)
-		b.WriteRune('-')
-		atoi(b, int64(t2.Day()), 2)
-		b.WriteRune('T')
-		atoi(b, int64(t2.Hour()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Minute()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Second()), 2)
-		b.WriteRune('.')
-		atoi(b, int64(t2.Nanosecond())/int64(time.Microsecond), 6)
-		b.WriteRune('Z')
+	"$time_rfc3339_us": func(b *[]byte, ev *LogEvent) {
+		t2 := ev.End
+		*b = appendInt(*b, int64(t2.Year()), 4)
+		*b = append(*b, '-')
+		*b = appendInt(*b, int64(t2.Month()), 2)
+		*b = append(*b, '-')
+		*b = appendInt(*b, int64(t2.Day()), 2)
+		*b = append(*b, 'T')
+		*b = appendInt(*b, int64(t2.Hour()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Minute()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Second()), 2)
+		*b = append(*b, '.')
+		*b = appendInt(*b, int64(t2.Nanosecond())/int64(time.Microsecond), 6)
+		*b = append(*b, 'Z')
 	},
-	"$time_rfc3339_ns": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		atoi(b, int64(t2.Year()), 4)
-		b.WriteRune('-')
-		atoi(b, int64(t2.Month()), 2)
-		b.WriteRune('-')
-		atoi(b, int64(t2.Day()), 2)
-		b.WriteRune('T')
-		atoi(b, int64(t2.Hour()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Minute()), 2)
-		b.WriteRune(':')
-		atoi(b, int64(t2.Second()), 2)
-		b.WriteRune('.')
-		atoi(b, int64(t2.Nanosecond()), 9)
-		b.WriteRune('Z')
+	"$time_rfc3339_ns": func(b *[]byte, ev *LogEvent) {
+		t2 := ev.End
+		*b = appendInt(*b, int64(t2.Year()), 4)
+		*b = append(*b, '-')
+		*b = appendInt(*b, int64(t2.Month()), 2)
+		*b = append(*b, '-')
+		*b = appendInt(*b, int64(t2.Day()), 2)
+		*b = append(*b, 'T')
+		*b = appendInt(*b, int64(t2.Hour()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Minute()), 2)
+		*b = append(*b, ':')
+		*b = appendInt(*b, int64(t2.Second()), 2)
+		*b = append(*b, '.')
+		*b = appendInt(*b, int64(t2.Nanosecond()), 9)
+		*b = append(*b, 'Z')
 	},
-	"$upstream_addr": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		b.WriteString(w.Request.RemoteAddr)
+	"$upstream_addr": func(b *[]byte, ev *LogEvent) {
+		*b = append(*b, ev.Response.Request.RemoteAddr...)
 	},
-	"$upstream_host": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		host, _, _ := net.SplitHostPort(w.Request.RemoteAddr)
-		b.WriteString(host)
+	"$upstream_host": func(b *[]byte, ev *LogEvent) {
+		host, _, _ := net.SplitHostPort(ev.Response.Request.RemoteAddr)
+		*b = append(*b, host...)
 	},
-	"$upstream_port": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-		_, port, _ := net.SplitHostPort(w.Request.RemoteAddr)
-		b.WriteString(port)
+	"$upstream_port": func(b *[]byte, ev *LogEvent) {
+		_, port, _ := net.SplitHostPort(ev.Response.Request.RemoteAddr)
+		*b = append(*b, port...)
 	},
 
-	//"$http_referer": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-	//	b.WriteString(r.Referer())
+	//"$http_referer": func(b *[]byte, ev *LogEvent) {
+	//	*b = append(*b, ev.Request.Referer()...)
 	//},
-	//"$http_user_agent": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-	//	b.WriteString(r.UserAgent())
+	//"$http_user_agent": func(b *[]byte, ev *LogEvent) {
+	//	*b = append(*b, ev.Request.UserAgent()...)
 	//},
-	//"$http_x_forwarded_for": func(b *bytes.Buffer, t1, t2 time.Time, w *http.Response, r *http.Request) {
-	//	b.WriteString(r.Header.Get("X-Forwarded-For"))
+	//"$http_x_forwarded_for": func(b *[]byte, ev *LogEvent) {
+	//	*b = append(*b, ev.Request.Header.Get("X-Forwarded-For")...)
 	//},
 }
 
@@ -288,6 +373,7 @@ const (
 	stateField
 	stateDot
 	stateHeader
+	stateMode
 )
 
 func lex(s []rune) (typ itemType, n int) {
@@ -296,6 +382,7 @@ func lex(s []rune) (typ itemType, n int) {
 	}
 
 	state := stateStart
+	isHeader := false
 	for i, r := range s {
 		switch state {
 		case stateStart:
@@ -330,6 +417,8 @@ func lex(s []rune) (typ itemType, n int) {
 				} else {
 					return itemField, i
 				}
+			case r == ':':
+				state = stateMode
 			case isIDChar(r):
 				// state = stateField
 			default:
@@ -340,17 +429,31 @@ func lex(s []rune) (typ itemType, n int) {
 			switch {
 			case isIDChar(r):
 				state = stateHeader
+				isHeader = true
 			default:
 				return itemField, i
 			}
 
 		case stateHeader:
 			switch {
+			case r == ':':
+				state = stateMode
 			case isIDChar(r):
 				// state = stateHeader
 			default:
 				return itemHeader, i
 			}
+
+		case stateMode:
+			switch {
+			case isIDChar(r):
+				// state = stateMode
+			default:
+				if isHeader {
+					return itemHeader, i
+				}
+				return itemField, i
+			}
 		}
 	}
 
@@ -361,6 +464,11 @@ func lex(s []rune) (typ itemType, n int) {
 		return itemField, len(s)
 	case stateHeader:
 		return itemHeader, len(s)
+	case stateMode:
+		if isHeader {
+			return itemHeader, len(s)
+		}
+		return itemField, len(s)
 	default:
 		return itemText, len(s)
 	}
@@ -0,0 +1,42 @@
+package logger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// requestIDHeaderDefault is the header $request_id reads from when
+// Config.RequestIDHeader is empty.
+const requestIDHeaderDefault = "X-Request-Id"
+
+// genRequestID returns a random hex-encoded request id, used when the
+// client did not send one.
+func genRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID returns a copy of base with a "$request_id" field that
+// reads the request id from header, generating one when the request
+// didn't send it.
+func withRequestID(base map[string]field, header string) map[string]field {
+	if header == "" {
+		header = requestIDHeaderDefault
+	}
+
+	fields := make(map[string]field, len(base)+1)
+	for k, v := range base {
+		fields[k] = v
+	}
+	fields["$request_id"] = func(b *[]byte, ev *LogEvent) {
+		id := ev.Request.Header.Get(header)
+		if id == "" {
+			id = genRequestID()
+		}
+		*b = append(*b, id...)
+	}
+	return fields
+}
@@ -0,0 +1,238 @@
+package logger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RotateConfig configures a Rotater.
+type RotateConfig struct {
+	// Dir is the directory the rotated segment files are written to.
+	Dir string
+
+	// Prefix names the segment files, e.g. "access" produces
+	// "access-<timestamp>.log".
+	Prefix string
+
+	// MaxSize rotates the current segment once it reaches this many
+	// bytes. Values <= 0 disable size-based rotation.
+	MaxSize int64
+
+	// MaxInterval rotates the current segment once it has been open for
+	// this long. Values <= 0 disable time-based rotation.
+	MaxInterval time.Duration
+
+	// Gzip compresses a segment once it has been rotated out.
+	Gzip bool
+
+	// QueueSize bounds the number of entries buffered between Write and
+	// the background writer goroutine. Once full, further entries are
+	// dropped and counted rather than blocking the caller. Defaults to
+	// 1024.
+	QueueSize int
+}
+
+// Rotater is a non-blocking, size- and time-based rotating io.Writer. Write
+// enqueues entries onto a bounded queue drained in batches by a single
+// background goroutine, so that a slow disk cannot back-pressure the
+// request path; once the queue is full, entries are dropped and counted
+// rather than blocking the caller.
+type Rotater struct {
+	cfg RotateConfig
+
+	queue   chan []byte
+	dropped int64
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotater creates a Rotater and starts its background writer goroutine.
+func NewRotater(cfg RotateConfig) *Rotater {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1024
+	}
+	r := &Rotater{cfg: cfg, queue: make(chan []byte, cfg.QueueSize), done: make(chan struct{}), stopped: make(chan struct{})}
+	go r.run()
+	return r
+}
+
+// Write enqueues p for asynchronous writing. It never blocks: if the queue
+// is full, the entry is dropped and counted in Dropped.
+func (r *Rotater) Write(p []byte) (int, error) {
+	cp := make([]byte, len(p))
+	copy(cp, p)
+	select {
+	case r.queue <- cp:
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of entries dropped so far because the queue
+// was full.
+func (r *Rotater) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
+
+// Close stops the background writer, flushing any queued entries, and
+// closes the current segment. It waits for the writer goroutine's final
+// flush to complete before closing the file, so no queued entries are lost.
+func (r *Rotater) Close() error {
+	close(r.done)
+	<-r.stopped
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		return r.f.Close()
+	}
+	return nil
+}
+
+// run drains the queue in batches so that a burst of small writes turns
+// into a handful of syscalls instead of one per entry.
+func (r *Rotater) run() {
+	defer close(r.stopped)
+
+	const flushInterval = 250 * time.Millisecond
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+	flush := func() {
+		if batch.Len() == 0 {
+			return
+		}
+		r.write(batch.Bytes())
+		batch.Reset()
+	}
+
+	for {
+		select {
+		case p := <-r.queue:
+			batch.Write(p)
+			if batch.Len() >= 64*1024 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-r.done:
+			r.drainQueue(&batch)
+			flush()
+			return
+		}
+	}
+}
+
+// drainQueue consumes any entries left on the queue without blocking, so
+// that Close doesn't lose entries that were written just before it but
+// hadn't yet been picked up by run's select loop.
+func (r *Rotater) drainQueue(batch *bytes.Buffer) {
+	for {
+		select {
+		case p := <-r.queue:
+			batch.Write(p)
+		default:
+			return
+		}
+	}
+}
+
+func (r *Rotater) write(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil || r.shouldRotateLocked() {
+		if err := r.rotateLocked(); err != nil {
+			return
+		}
+	}
+	n, _ := r.f.Write(p)
+	r.size += int64(n)
+}
+
+func (r *Rotater) shouldRotateLocked() bool {
+	if r.cfg.MaxSize > 0 && r.size >= r.cfg.MaxSize {
+		return true
+	}
+	if r.cfg.MaxInterval > 0 && time.Since(r.opened) >= r.cfg.MaxInterval {
+		return true
+	}
+	return false
+}
+
+func (r *Rotater) rotateLocked() error {
+	old := r.f
+	name := filepath.Join(r.cfg.Dir, fmt.Sprintf("%s-%d.log", r.cfg.Prefix, time.Now().UnixNano()))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	r.size = 0
+	r.opened = time.Now()
+
+	if old != nil {
+		oldName := old.Name()
+		old.Close()
+		if r.cfg.Gzip {
+			go gzipFile(oldName)
+		}
+	}
+	return nil
+}
+
+// gzipFile compresses path into path+".gz" and removes the uncompressed
+// original. It runs in its own goroutine so that rotation never blocks the
+// writer loop.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		gw.Close()
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// withDroppedTotal returns a copy of base with a "$dropped_total" field
+// that reports how many entries rot has dropped because its queue was
+// full, so operators can see log back-pressure directly in the log line
+// instead of having to scrape a separate metric.
+func withDroppedTotal(base map[string]field, rot *Rotater) map[string]field {
+	fields := make(map[string]field, len(base)+1)
+	for k, v := range base {
+		fields[k] = v
+	}
+	fields["$dropped_total"] = func(b *[]byte, ev *LogEvent) {
+		*b = strconv.AppendInt(*b, rot.Dropped(), 10)
+	}
+	return fields
+}
@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+)
+
+// Sink is the destination a Logger writes rendered entries to. A Sink must
+// be safe for concurrent use since Log may be called from many handler
+// goroutines at once.
+type Sink interface {
+	Write(p []byte) (n int, err error)
+}
+
+// writerSink adapts an io.Writer to a Sink.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) Write(p []byte) (int, error) { return s.w.Write(p) }
+
+// WriterSink returns a Sink that writes entries to w, e.g. os.Stdout or a
+// bytes.Buffer in tests.
+func WriterSink(w io.Writer) Sink {
+	return writerSink{w: w}
+}
+
+// FileSink returns a Sink that appends entries to the file at path,
+// creating it if it does not exist yet.
+func FileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("logger: cannot open %s: %s", path, err)
+	}
+	return WriterSink(f), nil
+}
+
+// SyslogSink returns a Sink that forwards entries to a syslog daemon.
+// network and addr are passed to syslog.Dial unchanged; network == ""
+// connects to the local syslog daemon.
+func SyslogSink(network, addr, tag string) (Sink, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+	if err != nil {
+		return nil, fmt.Errorf("logger: cannot connect to syslog: %s", err)
+	}
+	return WriterSink(w), nil
+}
+
+// NetSink returns a Sink that writes entries to a UDP or TCP socket so that
+// they can be shipped directly to a log-aggregation pipeline. network is
+// "udp" or "tcp".
+func NetSink(network, addr string) (Sink, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("logger: cannot dial %s %s: %s", network, addr, err)
+	}
+	return WriterSink(conn), nil
+}
+
+// ChanSink is a Sink that delivers a copy of each entry on a channel
+// instead of writing it synchronously, e.g. to batch entries for async
+// delivery. Entries are dropped if the channel is full so that a slow
+// consumer cannot block the request path.
+type ChanSink chan []byte
+
+// NewChanSink creates a ChanSink buffering up to n entries.
+func NewChanSink(n int) ChanSink {
+	return make(ChanSink, n)
+}
+
+func (s ChanSink) Write(p []byte) (int, error) {
+	cp := make([]byte, len(p))
+	copy(cp, p)
+	select {
+	case s <- cp:
+	default:
+		// consumer is too slow: drop the entry rather than block.
+	}
+	return len(p), nil
+}
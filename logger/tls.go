@@ -0,0 +1,95 @@
+package logger
+
+import (
+	"crypto/tls"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// withTLSFields returns a copy of base with the TLS, scheme and
+// upstream-timing fields added, following the same copy-on-extend
+// convention as withRequestID and withDroppedTotal rather than mutating the
+// shared field table in place.
+func withTLSFields(base map[string]field) map[string]field {
+	fields := make(map[string]field, len(base)+8)
+	for k, v := range base {
+		fields[k] = v
+	}
+	fields["$scheme"] = func(b *[]byte, ev *LogEvent) {
+		*b = append(*b, scheme(ev)...)
+	}
+	fields["$ssl_protocol"] = func(b *[]byte, ev *LogEvent) {
+		if ev.Request.TLS == nil {
+			return
+		}
+		*b = append(*b, tls.VersionName(ev.Request.TLS.Version)...)
+	}
+	fields["$ssl_cipher"] = func(b *[]byte, ev *LogEvent) {
+		if ev.Request.TLS == nil {
+			return
+		}
+		*b = append(*b, tls.CipherSuiteName(ev.Request.TLS.CipherSuite)...)
+	}
+	fields["$ssl_server_name"] = func(b *[]byte, ev *LogEvent) {
+		if ev.Request.TLS == nil {
+			return
+		}
+		*b = append(*b, ev.Request.TLS.ServerName...)
+	}
+	fields["$request_length"] = func(b *[]byte, ev *LogEvent) {
+		*b = strconv.AppendInt(*b, requestLength(ev), 10)
+	}
+	fields["$upstream_response_time"] = func(b *[]byte, ev *LogEvent) {
+		*b = appendDurationMs(*b, ev.UpstreamEnd.Sub(ev.UpstreamStart))
+	}
+	fields["$upstream_connect_time"] = func(b *[]byte, ev *LogEvent) {
+		*b = appendDurationMs(*b, ev.UpstreamConnectEnd.Sub(ev.UpstreamConnectStart))
+	}
+	fields["$upstream_status"] = func(b *[]byte, ev *LogEvent) {
+		*b = strconv.AppendInt(*b, int64(ev.UpstreamStatus), 10)
+	}
+	return fields
+}
+
+// scheme reports the client-facing scheme of the request: http, https, ws
+// or wss, derived from whether the connection was TLS-terminated and
+// whether the request asked to be upgraded to a websocket.
+func scheme(ev *LogEvent) string {
+	r := ev.Request
+	ws := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	switch {
+	case r.TLS != nil && ws:
+		return "wss"
+	case r.TLS != nil:
+		return "https"
+	case ws:
+		return "ws"
+	default:
+		return "http"
+	}
+}
+
+// requestLength approximates the number of bytes read from the client for
+// this request, including the request line and headers, since that byte
+// count isn't otherwise retained once the request has been parsed.
+func requestLength(ev *LogEvent) int64 {
+	r := ev.Request
+	var n int64 = int64(len(r.Method)) + int64(len(r.RequestURI)) + int64(len(r.Proto)) + 4 // 2 spaces + CRLF
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			n += int64(len(k)) + int64(len(v)) + 4 // ": " + CRLF
+		}
+	}
+	return n + 2 // trailing CRLF after the header block
+}
+
+// appendDurationMs appends d formatted as seconds.milliseconds, the same
+// layout $response_time_ms uses.
+func appendDurationMs(b []byte, d time.Duration) []byte {
+	ns := d.Nanoseconds()
+	s, ms := ns/int64(time.Second), (ns%int64(time.Second))/int64(time.Millisecond)
+	b = strconv.AppendInt(b, s, 10)
+	b = append(b, '.')
+	return appendInt(b, ms, 3)
+}